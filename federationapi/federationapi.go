@@ -0,0 +1,57 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/postgres"
+	"github.com/matrix-org/dendrite/federationapi/storage/shared"
+	"github.com/matrix-org/dendrite/federationapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// eduExpiryJanitorInterval is how often the janitor sweeps
+// federationsender_queue_edus for rows past their expires_at.
+const eduExpiryJanitorInterval = 5 * time.Minute
+
+// NewDatabase opens the federation sender's queue storage for the given
+// dialect and starts the expired-EDU janitor against it. This is the one
+// place both of those need to happen together: opening the
+// *shared.Database without also calling StartEDUExpiryJanitor here would
+// leave expired typing notifications and receipts queued forever for an
+// unreachable destination.
+func NewDatabase(processCtx context.Context, dialect string, db *sql.DB, writer sqlutil.Writer) (*shared.Database, error) {
+	var eduDB *shared.Database
+	var err error
+	switch dialect {
+	case "postgres":
+		eduDB, err = postgres.NewDatabase(db, writer)
+	case "sqlite3":
+		eduDB, err = sqlite3.NewDatabase(db, writer)
+	default:
+		return nil, fmt.Errorf("federationapi: unknown database dialect %q", dialect)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open federationapi database: %w", err)
+	}
+
+	StartEDUExpiryJanitor(processCtx, eduDB, eduExpiryJanitorInterval)
+
+	return eduDB, nil
+}
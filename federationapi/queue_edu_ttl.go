@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(queueEDUsPurgedTotal)
+}
+
+// queueEDUsPurgedTotal counts how many queued EDUs the janitor has
+// removed for being past their expires_at.
+var queueEDUsPurgedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "queue_edus_purged_total",
+		Help:      "The total number of queued EDUs purged for being expired",
+	},
+)
+
+// expiringEDUStorage is the subset of federationapi/storage/shared.Database
+// that the janitor needs in order to remove expired rows. Note it takes
+// now as a parameter rather than calling time.Now itself - shared.Database
+// does the unix-timestamp conversion, so the janitor only ever deals with
+// its own injectable clock.
+type expiringEDUStorage interface {
+	PurgeExpiredEDUs(ctx context.Context, now time.Time) (int64, error)
+}
+
+// eduJanitor periodically deletes queued EDUs whose expires_at has
+// passed, so that a prolonged outage to a destination doesn't leave us
+// attempting to deliver stale typing notifications and receipts once it
+// comes back.
+type eduJanitor struct {
+	db expiringEDUStorage
+	// now is an injectable clock so that tests can fast-forward time
+	// instead of sleeping for real.
+	now      func() time.Time
+	interval time.Duration
+}
+
+// newEDUJanitor constructs an eduJanitor that purges expired EDUs from db
+// every interval, using time.Now for its clock. db is typically a
+// *federationapi/storage/shared.Database backed by either the postgres
+// or sqlite3 federationsender_queue_edus table.
+func newEDUJanitor(db expiringEDUStorage, interval time.Duration) *eduJanitor {
+	return &eduJanitor{
+		db:       db,
+		now:      time.Now,
+		interval: interval,
+	}
+}
+
+// StartEDUExpiryJanitor constructs an eduJanitor for db and starts it
+// running in its own goroutine, purging every interval until ctx is
+// cancelled. This is the call federationapi's component setup should
+// make once, alongside opening its storage.Database, so that the
+// janitor this file defines actually runs instead of sitting unused.
+func StartEDUExpiryJanitor(ctx context.Context, db expiringEDUStorage, interval time.Duration) {
+	j := newEDUJanitor(db, interval)
+	go j.Run(ctx)
+}
+
+// Run purges expired EDUs every j.interval until ctx is cancelled.
+func (j *eduJanitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.purgeExpired(ctx)
+		}
+	}
+}
+
+func (j *eduJanitor) purgeExpired(ctx context.Context) {
+	purged, err := j.db.PurgeExpiredEDUs(ctx, j.now())
+	if err != nil {
+		logrus.WithError(err).Error("eduJanitor: failed to purge expired queued EDUs")
+		return
+	}
+	if purged > 0 {
+		queueEDUsPurgedTotal.Add(float64(purged))
+		logrus.WithField("count", purged).Info("eduJanitor: purged expired queued EDUs")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeExpiringEDUStorage is an in-memory stand-in for
+// federationapi/storage/shared.Database, recording when it was asked to
+// purge and letting the test control what it reports as removed.
+type fakeExpiringEDUStorage struct {
+	calls       []time.Time
+	purgedStock int64
+}
+
+func (f *fakeExpiringEDUStorage) PurgeExpiredEDUs(ctx context.Context, now time.Time) (int64, error) {
+	f.calls = append(f.calls, now)
+	purged := f.purgedStock
+	f.purgedStock = 0
+	return purged, nil
+}
+
+// TestEDUJanitorUsesInjectedClock checks that the janitor's purge sweep
+// uses the clock it was given rather than the real wall clock, so tests
+// can fast-forward time instead of sleeping for real.
+func TestEDUJanitorUsesInjectedClock(t *testing.T) {
+	fake := &fakeExpiringEDUStorage{}
+	fakeNow := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	j := newEDUJanitor(fake, time.Minute)
+	j.now = func() time.Time { return fakeNow }
+
+	j.purgeExpired(context.Background())
+	if len(fake.calls) != 1 {
+		t.Fatalf("expected 1 purge call, got %d", len(fake.calls))
+	}
+	if !fake.calls[0].Equal(fakeNow) {
+		t.Fatalf("expected purge to use injected clock %v, got %v", fakeNow, fake.calls[0])
+	}
+
+	// Fast-forward the injected clock by a week and purge again - the
+	// janitor should pick up the new time immediately, with no sleeping.
+	fakeNow = fakeNow.Add(7 * 24 * time.Hour)
+	j.purgeExpired(context.Background())
+	if len(fake.calls) != 2 {
+		t.Fatalf("expected 2 purge calls, got %d", len(fake.calls))
+	}
+	if !fake.calls[1].Equal(fakeNow) {
+		t.Fatalf("expected second purge to use fast-forwarded clock %v, got %v", fakeNow, fake.calls[1])
+	}
+}
+
+// TestEDUJanitorReportsCount checks that a purge which actually removes
+// rows adds that count to queueEDUsPurgedTotal, not just that the
+// storage layer was asked to purge.
+func TestEDUJanitorReportsCount(t *testing.T) {
+	fake := &fakeExpiringEDUStorage{purgedStock: 3}
+	j := newEDUJanitor(fake, time.Minute)
+	j.now = func() time.Time { return time.Unix(0, 0) }
+
+	before := testutil.ToFloat64(queueEDUsPurgedTotal)
+	j.purgeExpired(context.Background())
+	after := testutil.ToFloat64(queueEDUsPurgedTotal)
+
+	if len(fake.calls) != 1 {
+		t.Fatalf("expected 1 purge call, got %d", len(fake.calls))
+	}
+	if got := after - before; got != 3 {
+		t.Fatalf("expected queueEDUsPurgedTotal to increase by 3, increased by %v", got)
+	}
+}
+
+// TestEDUJanitorDoesNotReportZeroPurges checks that a no-op sweep (the
+// common case) doesn't touch the counter at all, so it isn't
+// misleadingly bumped every interval.
+func TestEDUJanitorDoesNotReportZeroPurges(t *testing.T) {
+	fake := &fakeExpiringEDUStorage{purgedStock: 0}
+	j := newEDUJanitor(fake, time.Minute)
+	j.now = func() time.Time { return time.Unix(0, 0) }
+
+	before := testutil.ToFloat64(queueEDUsPurgedTotal)
+	j.purgeExpired(context.Background())
+	after := testutil.ToFloat64(queueEDUsPurgedTotal)
+
+	if after != before {
+		t.Fatalf("expected queueEDUsPurgedTotal to be unchanged, went from %v to %v", before, after)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const queueEDUsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_queue_edus (
+	-- The JSON NID for the EDU
+	json_nid BIGINT NOT NULL,
+	-- The destination server name
+	server_name TEXT NOT NULL,
+	-- The EDU's type, e.g. m.typing. Kept alongside the row so that the
+	-- expiry janitor and TTL lookups don't need to go back to the JSON
+	-- blob just to know what they're looking at.
+	edu_type TEXT NOT NULL DEFAULT '',
+	-- The unix timestamp (ms) after which this EDU is no longer useful
+	-- and should not be sent, even if still queued. 0 means it never
+	-- expires.
+	expires_at BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (json_nid, server_name)
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_edus_server_name_idx
+	ON federationsender_queue_edus (server_name);
+`
+
+const insertQueueEDUSQL = `
+	INSERT INTO federationsender_queue_edus (json_nid, server_name, edu_type, expires_at)
+	VALUES ($1, $2, $3, $4)
+`
+
+const selectQueueEDUsSQL = `
+	SELECT json_nid FROM federationsender_queue_edus
+	WHERE server_name = $1 AND (expires_at = 0 OR expires_at > $2)
+	LIMIT $3
+`
+
+const deleteQueueEDUsSQL = `
+	DELETE FROM federationsender_queue_edus WHERE server_name = $1 AND json_nid = ANY($2)
+`
+
+const deleteExpiredEDUsSQL = `
+	DELETE FROM federationsender_queue_edus WHERE expires_at <> 0 AND expires_at < $1
+`
+
+type queueEDUsStatements struct {
+	insertQueueEDUStmt    *sql.Stmt
+	selectQueueEDUsStmt   *sql.Stmt
+	deleteQueueEDUsStmt   *sql.Stmt
+	deleteExpiredEDUsStmt *sql.Stmt
+}
+
+func NewPostgresQueueEDUsTable(db *sql.DB) (s *queueEDUsStatements, err error) {
+	s = &queueEDUsStatements{}
+	_, err = db.Exec(queueEDUsSchema)
+	if err != nil {
+		return
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertQueueEDUStmt, insertQueueEDUSQL},
+		{&s.selectQueueEDUsStmt, selectQueueEDUsSQL},
+		{&s.deleteQueueEDUsStmt, deleteQueueEDUsSQL},
+		{&s.deleteExpiredEDUsStmt, deleteExpiredEDUsSQL},
+	}.Prepare(db)
+}
+
+// InsertQueueEDU records that an EDU of the given type is queued for
+// serverName. expiresAt is the unix timestamp in milliseconds after
+// which it's fine to drop the EDU without sending it, or 0 if it should
+// never expire.
+func (s *queueEDUsStatements) InsertQueueEDU(
+	ctx context.Context, txn *sql.Tx,
+	jsonNID int64, serverName, eduType string, expiresAt int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertQueueEDUStmt)
+	_, err := stmt.ExecContext(ctx, jsonNID, serverName, eduType, expiresAt)
+	return err
+}
+
+// SelectQueueEDUs returns the JSON NIDs of up to limit EDUs queued for
+// serverName that have not yet expired as of now.
+func (s *queueEDUsStatements) SelectQueueEDUs(
+	ctx context.Context, txn *sql.Tx, serverName string, now int64, limit int,
+) ([]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectQueueEDUsStmt)
+	rows, err := stmt.QueryContext(ctx, serverName, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint:errcheck
+
+	var result []int64
+	for rows.Next() {
+		var jsonNID int64
+		if err = rows.Scan(&jsonNID); err != nil {
+			return nil, err
+		}
+		result = append(result, jsonNID)
+	}
+	return result, rows.Err()
+}
+
+// DeleteQueueEDUs removes the given JSON NIDs queued for serverName.
+func (s *queueEDUsStatements) DeleteQueueEDUs(
+	ctx context.Context, txn *sql.Tx, serverName string, jsonNIDs []int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteQueueEDUsStmt)
+	_, err := stmt.ExecContext(ctx, serverName, pq.Int64Array(jsonNIDs))
+	return err
+}
+
+// PurgeExpiredEDUs deletes every queued EDU whose expires_at is non-zero
+// and before now, returning the number of rows removed.
+func (s *queueEDUsStatements) PurgeExpiredEDUs(
+	ctx context.Context, txn *sql.Tx, now int64,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredEDUsStmt)
+	res, err := stmt.ExecContext(ctx, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge expired queue EDUs: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/postgres/deltas"
+	"github.com/matrix-org/dendrite/federationapi/storage/shared"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// NewDatabase opens the postgres-backed federationsender_queue_edus
+// table and wraps it in a shared.Database, so that TTL-aware inserts and
+// expiry purging are available without the caller needing to touch SQL
+// or *sql.Tx directly.
+func NewDatabase(db *sql.DB, writer sqlutil.Writer) (*shared.Database, error) {
+	m := sqlutil.NewMigrations()
+	deltas.LoadAddExpiresAt(m)
+	deltas.LoadAddEDUType(m)
+	if err := m.RunDeltas(db); err != nil {
+		return nil, fmt.Errorf("failed to run federationsender_queue_edus migrations: %w", err)
+	}
+
+	queueEDUs, err := NewPostgresQueueEDUsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	return &shared.Database{
+		DB:        db,
+		Writer:    writer,
+		QueueEDUs: queueEDUs,
+	}, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shared holds the backend-independent half of the federation
+// sender's queue storage: the piece that knows about transactions,
+// per-EDU-type TTLs and expiry, but not about postgres vs sqlite SQL
+// dialects.
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// QueueEDUsTable is satisfied by the postgres and sqlite3
+// implementations of the federationsender_queue_edus table. Every method
+// takes the *sql.Tx to run in; Database below is what hides that detail
+// from callers such as the outgoing queues and the expiry janitor.
+type QueueEDUsTable interface {
+	InsertQueueEDU(ctx context.Context, txn *sql.Tx, jsonNID int64, serverName, eduType string, expiresAt int64) error
+	SelectQueueEDUs(ctx context.Context, txn *sql.Tx, serverName string, now int64, limit int) ([]int64, error)
+	DeleteQueueEDUs(ctx context.Context, txn *sql.Tx, serverName string, jsonNIDs []int64) error
+	PurgeExpiredEDUs(ctx context.Context, txn *sql.Tx, now int64) (int64, error)
+}
+
+// Database wraps a QueueEDUsTable with transaction handling, so that
+// callers don't need to know about *sql.Tx, and with the per-EDU-type
+// TTL table, so that callers don't need to know about expires_at either.
+type Database struct {
+	DB        *sql.DB
+	Writer    sqlutil.Writer
+	QueueEDUs QueueEDUsTable
+}
+
+// DefaultEDUExpiries gives each EDU type a sensible default time-to-live
+// for how long it's worth keeping it queued for an unreachable
+// destination. EDU types not listed here fall back to DefaultEDUExpiry.
+// It's exported so that a component's config can start from it and
+// override individual entries, rather than being stuck with it.
+var DefaultEDUExpiries = map[string]time.Duration{
+	"m.typing":             5 * time.Minute,
+	"m.receipt":            time.Hour,
+	"m.presence":           5 * time.Minute,
+	"m.device_list_update": 7 * 24 * time.Hour,
+	"m.direct_to_device":   0, // never expires
+}
+
+// DefaultEDUExpiry is used for any EDU type not listed in the TTL
+// config map passed to ExpiresAtForEDU.
+const DefaultEDUExpiry = 24 * time.Hour
+
+// ExpiresAtForEDU works out the expires_at (unix milliseconds) that
+// should be stored alongside a queued EDU of the given type, relative to
+// now. ttls is the per-EDU-type TTL config to use; if it's nil,
+// DefaultEDUExpiries applies. A TTL of 0 means the EDU never expires,
+// which is recorded as an expires_at of 0.
+func ExpiresAtForEDU(ttls map[string]time.Duration, eduType string, now time.Time) int64 {
+	if ttls == nil {
+		ttls = DefaultEDUExpiries
+	}
+	ttl, ok := ttls[eduType]
+	if !ok {
+		ttl = DefaultEDUExpiry
+	}
+	if ttl == 0 {
+		return 0
+	}
+	return gomatrixserverlib.AsTimestamp(now.Add(ttl))
+}
+
+// InsertQueueEDU records that an EDU of the given type is queued for
+// serverName, computing its expiry from ttls (or DefaultEDUExpiries if
+// ttls is nil) relative to now.
+func (d *Database) InsertQueueEDU(
+	ctx context.Context, eduType, serverName string, jsonNID int64, now time.Time, ttls map[string]time.Duration,
+) error {
+	expiresAt := ExpiresAtForEDU(ttls, eduType, now)
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.QueueEDUs.InsertQueueEDU(ctx, txn, jsonNID, serverName, eduType, expiresAt)
+	})
+}
+
+// SelectQueueEDUs returns up to limit queued EDU JSON NIDs for
+// serverName, excluding any that have already expired as of now. This is
+// what a destination's outgoing queue should call when it wakes up to
+// pop work, so that it never bothers sending something PurgeExpiredEDUs
+// would otherwise have thrown away.
+func (d *Database) SelectQueueEDUs(
+	ctx context.Context, serverName string, now time.Time, limit int,
+) ([]int64, error) {
+	var result []int64
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var err error
+		result, err = d.QueueEDUs.SelectQueueEDUs(ctx, txn, serverName, gomatrixserverlib.AsTimestamp(now), limit)
+		return err
+	})
+	return result, err
+}
+
+// DeleteQueueEDUs removes the given queued EDU JSON NIDs for serverName.
+func (d *Database) DeleteQueueEDUs(ctx context.Context, serverName string, jsonNIDs []int64) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.QueueEDUs.DeleteQueueEDUs(ctx, txn, serverName, jsonNIDs)
+	})
+}
+
+// PurgeExpiredEDUs deletes every queued EDU whose expiry has passed as of
+// now, returning the number of rows removed. This is what the janitor in
+// federationapi calls on a timer.
+func (d *Database) PurgeExpiredEDUs(ctx context.Context, now time.Time) (int64, error) {
+	var purged int64
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var err error
+		purged, err = d.QueueEDUs.PurgeExpiredEDUs(ctx, txn, gomatrixserverlib.AsTimestamp(now))
+		return err
+	})
+	return purged, err
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file lives in package shared_test, rather than shared, so that it
+// can import the sqlite3 backend to get a real *shared.Database: sqlite3
+// itself imports shared, so a test that needs both from inside package
+// shared would be an import cycle.
+package shared_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	// The sqlite3 driver is only ever registered by whichever binary
+	// wires up a real federationapi database; pull it in directly here
+	// so this test can open one of its own.
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/shared"
+	"github.com/matrix-org/dendrite/federationapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// mustOpenQueueEDUsDatabase opens a fresh in-memory sqlite-backed
+// shared.Database, independent of every other test in this package.
+func mustOpenQueueEDUsDatabase(t *testing.T) *shared.Database {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatalf("failed to open sqlite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	d, err := sqlite3.NewDatabase(db, sqlutil.NewExclusiveWriter())
+	if err != nil {
+		t.Fatalf("sqlite3.NewDatabase: %v", err)
+	}
+	return d
+}
+
+// TestQueueEDUsInsertSelectPurge exercises InsertQueueEDU, SelectQueueEDUs
+// and PurgeExpiredEDUs together against a real sqlite database, using an
+// injectable "now" at each step rather than sleeping, so that the test is
+// deterministic about which EDUs count as expired at which point.
+func TestQueueEDUsInsertSelectPurge(t *testing.T) {
+	ctx := context.Background()
+	d := mustOpenQueueEDUsDatabase(t)
+
+	insertedAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttls := map[string]time.Duration{
+		"m.typing":           time.Minute,
+		"m.direct_to_device": 0, // never expires
+	}
+
+	if err := d.InsertQueueEDU(ctx, "m.typing", "far-away.example.com", 1, insertedAt, ttls); err != nil {
+		t.Fatalf("InsertQueueEDU (expiring): %v", err)
+	}
+	if err := d.InsertQueueEDU(ctx, "m.direct_to_device", "far-away.example.com", 2, insertedAt, ttls); err != nil {
+		t.Fatalf("InsertQueueEDU (never expires): %v", err)
+	}
+
+	beforeExpiry := insertedAt.Add(30 * time.Second)
+	got, err := d.SelectQueueEDUs(ctx, "far-away.example.com", beforeExpiry, 10)
+	if err != nil {
+		t.Fatalf("SelectQueueEDUs (before expiry): %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected both EDUs to still be selectable before expiry, got %v", got)
+	}
+
+	afterExpiry := insertedAt.Add(2 * time.Minute)
+	got, err = d.SelectQueueEDUs(ctx, "far-away.example.com", afterExpiry, 10)
+	if err != nil {
+		t.Fatalf("SelectQueueEDUs (after expiry): %v", err)
+	}
+	if len(got) != 1 || got[0] != 2 {
+		t.Fatalf("expected only the never-expiring EDU to still be selectable after expiry, got %v", got)
+	}
+
+	purged, err := d.PurgeExpiredEDUs(ctx, afterExpiry)
+	if err != nil {
+		t.Fatalf("PurgeExpiredEDUs: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 row purged, got %d", purged)
+	}
+
+	// A second purge at the same time has nothing left to remove.
+	purged, err = d.PurgeExpiredEDUs(ctx, afterExpiry)
+	if err != nil {
+		t.Fatalf("PurgeExpiredEDUs (second call): %v", err)
+	}
+	if purged != 0 {
+		t.Fatalf("expected second purge to remove nothing, got %d", purged)
+	}
+
+	got, err = d.SelectQueueEDUs(ctx, "far-away.example.com", afterExpiry, 10)
+	if err != nil {
+		t.Fatalf("SelectQueueEDUs (after purge): %v", err)
+	}
+	if len(got) != 1 || got[0] != 2 {
+		t.Fatalf("expected the never-expiring EDU to survive the purge, got %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestExpiresAtForEDU(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		eduType string
+		wantTTL time.Duration
+	}{
+		{"m.typing", 5 * time.Minute},
+		{"m.receipt", time.Hour},
+		{"m.presence", 5 * time.Minute},
+		{"m.device_list_update", 7 * 24 * time.Hour},
+		{"m.some_unknown_type", DefaultEDUExpiry},
+	}
+
+	for _, c := range cases {
+		got := ExpiresAtForEDU(nil, c.eduType, now)
+		want := gomatrixserverlib.AsTimestamp(now.Add(c.wantTTL))
+		if got != want {
+			t.Errorf("ExpiresAtForEDU(nil, %q, now) = %d, want %d", c.eduType, got, want)
+		}
+	}
+}
+
+func TestExpiresAtForEDUNeverExpires(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	got := ExpiresAtForEDU(nil, "m.direct_to_device", now)
+	if got != 0 {
+		t.Errorf("ExpiresAtForEDU(nil, m.direct_to_device, now) = %d, want 0 (never expires)", got)
+	}
+}
+
+// TestExpiresAtForEDUConfigOverride checks that a caller-supplied TTL map
+// takes precedence over DefaultEDUExpiries, so that e.g. federationapi's
+// component config can shorten or lengthen a type's TTL without needing
+// a code change here.
+func TestExpiresAtForEDUConfigOverride(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := map[string]time.Duration{
+		"m.typing": time.Second,
+	}
+
+	got := ExpiresAtForEDU(cfg, "m.typing", now)
+	want := gomatrixserverlib.AsTimestamp(now.Add(time.Second))
+	if got != want {
+		t.Errorf("ExpiresAtForEDU(cfg, m.typing, now) = %d, want %d", got, want)
+	}
+
+	// A type not present in the override map still falls back to
+	// DefaultEDUExpiry, not to DefaultEDUExpiries["m.receipt"].
+	got = ExpiresAtForEDU(cfg, "m.receipt", now)
+	want = gomatrixserverlib.AsTimestamp(now.Add(DefaultEDUExpiry))
+	if got != want {
+		t.Errorf("ExpiresAtForEDU(cfg, m.receipt, now) = %d, want %d", got, want)
+	}
+}
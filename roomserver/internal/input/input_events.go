@@ -53,11 +53,11 @@ var processRoomEventDuration = prometheus.NewHistogramVec(
 	[]string{"room_id"},
 )
 
-// processRoomEvent can only be called once at a time
-//
-// TODO(#375): This should be rewritten to allow concurrent calls. The
-// difficulty is in ensuring that we correctly annotate events with the correct
-// state deltas when sending to kafka streams
+// processRoomEvent must only be called for one room at a time, serialised
+// by the room's roomWorker (see InputRoomEvent in input_worker.go), so
+// that we correctly annotate events with the correct state deltas when
+// sending to kafka streams. Events for different rooms may safely call
+// this concurrently.
 // TODO: Break up function - we should probably do transaction ID checks before calling this.
 // nolint:gocyclo
 func (r *Inputer) processRoomEvent(
@@ -327,14 +327,6 @@ func (r *Inputer) checkForMissingAuthEvents(
 	return nil
 }
 
-func (r *Inputer) checkForMissingPrevEvents(
-	ctx context.Context,
-	input *api.InputRoomEvent,
-) error {
-
-	return nil
-}
-
 func (r *Inputer) calculateAndSetState(
 	ctx context.Context,
 	input *api.InputRoomEvent,
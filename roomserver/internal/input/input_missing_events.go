@@ -0,0 +1,404 @@
+// Copyright 2017 Vector Creations Ltd
+// Copyright 2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(missingPrevEventsGapTotal)
+}
+
+// missingPrevEventsGapTotal counts the number of times we failed to close
+// a prev_events gap within maxMissingEventsDepth and had to fall back to
+// fetching state at the event instead.
+var missingPrevEventsGapTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "missing_prev_events_gap_total",
+		Help:      "The total number of times a prev_events gap could not be closed via /get_missing_events and state was fetched instead",
+	},
+	[]string{"room_id"},
+)
+
+const (
+	// maxMissingEventsDepth is how many times we are prepared to recurse
+	// (backfilled event -> its own missing prev_events -> ...) while
+	// closing a gap before giving up and falling back to fetching state
+	// at the event instead. This bounds the total amount of recursive
+	// backfilling a single event can trigger; it is not a fan-out size.
+	maxMissingEventsDepth = 20
+
+	// missingEventsFetchBreadth is how many events we ask for in a
+	// single /get_missing_events call. It is independent of
+	// maxMissingEventsDepth: depth bounds how many times we're willing
+	// to recurse, breadth bounds how much a single one of those calls
+	// can return. Conflating the two would mean that by the time we're
+	// several hops deep into closing a gap, we'd only ever ask for one
+	// or two events at a time.
+	missingEventsFetchBreadth = 20
+)
+
+// contextKeyMissingEventsDepth is the context key used to thread the
+// remaining backfill depth budget through recursive calls to
+// checkForMissingPrevEvents (via processRoomEvent) when a backfilled
+// event itself turns out to have missing prev_events.
+type contextKeyMissingEventsDepth struct{}
+
+// remainingMissingEventsDepth returns how many more hops of recursive
+// backfill we're prepared to make while chasing this gap, before giving
+// up and fetching state instead. It defaults to maxMissingEventsDepth
+// for the top-level call.
+func remainingMissingEventsDepth(ctx context.Context) int {
+	if v, ok := ctx.Value(contextKeyMissingEventsDepth{}).(int); ok {
+		return v
+	}
+	return maxMissingEventsDepth
+}
+
+// withRemainingMissingEventsDepth returns a context carrying the given
+// remaining depth budget, for passing to the recursive processRoomEvent
+// calls made while backfilling missing prev_events.
+func withRemainingMissingEventsDepth(ctx context.Context, remaining int) context.Context {
+	return context.WithValue(ctx, contextKeyMissingEventsDepth{}, remaining)
+}
+
+// missingEventsFetcher is the subset of the federation internal API
+// (r.FSAPI) that closing a prev_events gap needs. It mirrors the real
+// federation client methods of the same name (LookupMissingEvents,
+// LookupState) rather than the request/response style used elsewhere in
+// this package, since those are what the federation internal API exposes
+// for this kind of direct federation lookup. Declaring it here, scoped
+// to just what this file uses, also means the logic below can be
+// exercised in tests without depending on the full federation internal
+// API surface.
+type missingEventsFetcher interface {
+	// LookupMissingEvents asks origin to close the gap between
+	// earliestEvents (what we have) and latestEvents (what we don't),
+	// equivalent to /get_missing_events. It returns at most limit
+	// events; an empty result (with no error) means origin could not or
+	// would not close the gap.
+	LookupMissingEvents(
+		ctx context.Context, origin gomatrixserverlib.ServerName, roomID string,
+		earliestEvents, latestEvents []string, limit int,
+		roomVersion gomatrixserverlib.RoomVersion,
+	) ([]*gomatrixserverlib.Event, error)
+
+	// LookupState asks origin for the full state and auth chain events
+	// at eventID, equivalent to /state. It returns actual event JSON
+	// rather than bare IDs, so that the state fallback in
+	// fetchStateAfterMissingEvents has something to store.
+	LookupState(
+		ctx context.Context, origin gomatrixserverlib.ServerName, roomID, eventID string,
+		roomVersion gomatrixserverlib.RoomVersion,
+	) (stateEvents, authEvents []*gomatrixserverlib.Event, err error)
+}
+
+// missingEventsStorage is the subset of the roomserver database that
+// storing the state and auth chain events fetched via /state needs. It
+// mirrors the corresponding calls made by checkForMissingAuthEvents
+// (input_events.go), which stores a federated auth chain the same way.
+type missingEventsStorage interface {
+	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	StoreEvent(
+		ctx context.Context, event *gomatrixserverlib.HeaderedEvent, authEventNIDs []types.EventNID, isRejected bool,
+	) (types.EventNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+}
+
+// checkForMissingPrevEvents asks the federation API for any prev_events
+// of the given input event that we don't already have, so that we are
+// able to calculate the state before the event.
+//
+// If we're missing prev_events, we ask the server that sent us the event
+// for the missing events via /get_missing_events. The returned events
+// are fed back into the roomserver as ordinary KindNew input events, in
+// reverse topological order, before we carry on processing the event
+// that triggered the backfill.
+//
+// If the gap turns out to be too large to close that way, we instead
+// fetch the state at the event via /state, so that the triggering event
+// can still be processed with HasState set, using the state we were
+// given rather than state we calculate ourselves.
+//
+// Closing a gap can itself surface further gaps: a backfilled event may
+// reference prev_events we don't have either. Each such hop consumes one
+// unit of the remaining depth budget carried on ctx (see
+// remainingMissingEventsDepth), so that no amount of recursion can turn
+// a single event into an unbounded amount of federation traffic.
+//
+// Unlike the first version of this method, there is deliberately no
+// dedup between concurrent calls here: Inputer now serialises all
+// processing for a given room through that room's single worker (see
+// input_worker.go), so two calls to checkForMissingPrevEvents for the
+// same room can never be in flight at once, and the dedup this used to
+// do never actually collapsed anything. Worse, it mutated only the
+// "winning" caller's *api.InputRoomEvent when falling back to state,
+// which would have left any other (deduplicated) caller's input
+// unmodified and still missing state. Per-room serialisation gives the
+// dedup this was trying to achieve for free and without that hazard.
+func (r *Inputer) checkForMissingPrevEvents(
+	ctx context.Context,
+	input *api.InputRoomEvent,
+) error {
+	if input.Kind != api.KindNew {
+		return nil
+	}
+
+	event := input.Event.Unwrap()
+	prevEventIDs := event.PrevEventIDs()
+	if len(prevEventIDs) == 0 {
+		return nil
+	}
+
+	knownEventNIDs, err := r.DB.EventNIDs(ctx, prevEventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	if len(knownEventNIDs) == len(prevEventIDs) {
+		// We already have all of the prev_events, nothing to do.
+		return nil
+	}
+
+	// Work out which prev_events are missing, and which we already have -
+	// the latter is what we tell the remote server we already hold, so
+	// its backward walk from the triggering event knows where to stop.
+	missingPrevEventIDs := make([]string, 0, len(prevEventIDs)-len(knownEventNIDs))
+	knownPrevEventIDs := make([]string, 0, len(knownEventNIDs))
+	for _, prevEventID := range prevEventIDs {
+		if _, ok := knownEventNIDs[prevEventID]; !ok {
+			missingPrevEventIDs = append(missingPrevEventIDs, prevEventID)
+		} else {
+			knownPrevEventIDs = append(knownPrevEventIDs, prevEventID)
+		}
+	}
+
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"event_id": event.EventID(),
+		"room_id":  event.RoomID(),
+		"missing":  missingPrevEventIDs,
+	})
+
+	remaining := remainingMissingEventsDepth(ctx)
+	if remaining <= 0 {
+		missingPrevEventsGapTotal.With(prometheus.Labels{
+			"room_id": event.RoomID(),
+		}).Inc()
+		logger.Warn("Exhausted missing prev_events depth budget, falling back to /state")
+		return fetchStateAfterMissingEvents(ctx, r.FSAPI, r.DB, input)
+	}
+
+	return fetchMissingPrevEvents(ctx, r.FSAPI, r.DB, r.processRoomEvent, input, knownPrevEventIDs, remaining, logger)
+}
+
+// fetchMissingPrevEvents does the actual work of closing the gap for
+// checkForMissingPrevEvents. It takes the federation fetcher and the
+// function used to process backfilled events as explicit parameters
+// (rather than reading them off an *Inputer) so that it can be unit
+// tested without a full Inputer.
+//
+// remaining is how many more hops of recursive backfill are allowed
+// before we must stop and fetch state instead; every backfilled event
+// from this call is re-submitted as KindNew with remaining reduced by one,
+// so each hop costs one unit and a chain of gap-within-a-gap events can't
+// cause unbounded federation traffic.
+//
+// knownPrevEventIDs is the subset of the triggering event's prev_events
+// that we already hold; it is passed to LookupMissingEvents as
+// earliestEvents so that origin's backward walk from the triggering
+// event stops at events we already have rather than at the very events
+// we're trying to fetch.
+func fetchMissingPrevEvents(
+	ctx context.Context,
+	fetcher missingEventsFetcher,
+	db missingEventsStorage,
+	processFn func(ctx context.Context, input *api.InputRoomEvent) (string, error),
+	input *api.InputRoomEvent,
+	knownPrevEventIDs []string,
+	remaining int,
+	logger *logrus.Entry,
+) error {
+	event := input.Event.Unwrap()
+
+	events, err := fetcher.LookupMissingEvents(
+		ctx, input.Origin, event.RoomID(),
+		knownPrevEventIDs, []string{event.EventID()}, missingEventsFetchBreadth,
+		input.Event.RoomVersion,
+	)
+	if err != nil {
+		return fmt.Errorf("fetcher.LookupMissingEvents: %w", err)
+	}
+
+	if len(events) == 0 {
+		// The remote server couldn't (or wouldn't) close the gap for us,
+		// so fall back to fetching the state at the event instead. We'll
+		// still process the triggering event, just with HasState set
+		// rather than having calculated the state ourselves.
+		missingPrevEventsGapTotal.With(prometheus.Labels{
+			"room_id": event.RoomID(),
+		}).Inc()
+		logger.Warn("Unable to close prev_events gap via /get_missing_events, falling back to /state")
+		return fetchStateAfterMissingEvents(ctx, fetcher, db, input)
+	}
+
+	// Feed the returned events back into the roomserver as regular
+	// KindNew inputs, oldest first, so that each one's own prev_events
+	// are satisfied by the time we get to the next. Each hop carries a
+	// reduced depth budget on its context so that if one of these
+	// backfilled events turns out to have a gap of its own, the total
+	// amount of recursive backfilling is still bounded.
+	backfillCtx := withRemainingMissingEventsDepth(ctx, remaining-1)
+	for _, backfilledEvent := range gomatrixserverlib.ReverseTopologicalOrdering(
+		events,
+		gomatrixserverlib.TopologicalOrderByPrevEvents,
+	) {
+		backfillInput := &api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        backfilledEvent.Headered(input.Event.RoomVersion),
+			Origin:       input.Origin,
+			SendAsServer: api.DoNotSendToOtherServers,
+		}
+		if _, err := processFn(backfillCtx, backfillInput); err != nil {
+			return fmt.Errorf("processFn (backfilled %s): %w", backfilledEvent.EventID(), err)
+		}
+	}
+
+	return nil
+}
+
+// fetchStateAfterMissingEvents is the fallback used when the gap in
+// prev_events could not be closed via /get_missing_events. It fetches
+// the full state and auth chain at the event (equivalent of /state) and
+// stores every event in it the same way checkForMissingAuthEvents stores
+// a federated auth chain, before marking the input event as carrying its
+// own state, so that calculateAndSetState's lookup of those state event
+// IDs in StateEntriesForEventIDs actually finds them rather than the
+// events we were missing in the first place.
+//
+// A state_ids-only fallback would leave us with event IDs we don't
+// hold locally - calculateAndSetState has no way to resolve those to
+// state entries, which is exactly the gap this fallback exists to
+// close.
+func fetchStateAfterMissingEvents(
+	ctx context.Context,
+	fetcher missingEventsFetcher,
+	db missingEventsStorage,
+	input *api.InputRoomEvent,
+) error {
+	event := input.Event.Unwrap()
+	roomVersion := input.Event.RoomVersion
+
+	stateEvents, authEvents, err := fetcher.LookupState(ctx, input.Origin, event.RoomID(), event.EventID(), roomVersion)
+	if err != nil {
+		return fmt.Errorf("fetcher.LookupState: %w", err)
+	}
+
+	// authEvents is the auth chain for stateEvents (and transitively for
+	// the triggering event), so store it first: stateEvents' own auth
+	// events need to already be in the database (or at least in cache)
+	// by the time we come to store them.
+	cache := map[string]types.EventNID{}
+	combined := make([]*gomatrixserverlib.Event, 0, len(authEvents)+len(stateEvents))
+	combined = append(combined, authEvents...)
+	combined = append(combined, stateEvents...)
+	if err := storeMissingStateEvents(ctx, db, combined, roomVersion, cache); err != nil {
+		return fmt.Errorf("storing /state response: %w", err)
+	}
+
+	stateEventIDs := make([]string, 0, len(stateEvents))
+	for _, stateEvent := range stateEvents {
+		stateEventIDs = append(stateEventIDs, stateEvent.EventID())
+	}
+	authEventIDs := make([]string, 0, len(authEvents))
+	for _, authEvent := range authEvents {
+		authEventIDs = append(authEventIDs, authEvent.EventID())
+	}
+
+	input.HasState = true
+	input.StateEventIDs = stateEventIDs
+	input.AuthEventIDs = authEventIDs
+
+	return nil
+}
+
+// storeMissingStateEvents stores events - already known to be a state
+// snapshot plus its auth chain, possibly with overlap between the two -
+// in an order where each event's own auth events are stored (or already
+// known) first. cache is shared across calls so that an event appearing
+// in both the auth chain and the state snapshot is only stored once, and
+// so that auth event NIDs looked up or just stored don't need a fresh
+// database round trip to be reused. It mirrors the storage loop in
+// checkForMissingAuthEvents (input_events.go), which does the same thing
+// for a federated auth chain fetched via QueryEventAuthFromFederation.
+func storeMissingStateEvents(
+	ctx context.Context,
+	db missingEventsStorage,
+	events []*gomatrixserverlib.Event,
+	roomVersion gomatrixserverlib.RoomVersion,
+	cache map[string]types.EventNID,
+) error {
+	for _, event := range gomatrixserverlib.ReverseTopologicalOrdering(
+		events,
+		gomatrixserverlib.TopologicalOrderByAuthEvents,
+	) {
+		if _, ok := cache[event.EventID()]; ok {
+			continue
+		}
+
+		neededAuthEventIDs := make([]string, 0, len(event.AuthEventIDs()))
+		for _, authEventID := range event.AuthEventIDs() {
+			if _, ok := cache[authEventID]; !ok {
+				neededAuthEventIDs = append(neededAuthEventIDs, authEventID)
+			}
+		}
+		if len(neededAuthEventIDs) > 0 {
+			knownAuthEventNIDs, err := db.EventNIDs(ctx, neededAuthEventIDs)
+			if err != nil {
+				return fmt.Errorf("db.EventNIDs: %w", err)
+			}
+			for authEventID, authEventNID := range knownAuthEventNIDs {
+				cache[authEventID] = authEventNID
+			}
+		}
+
+		authEventNIDs := make([]types.EventNID, 0, len(event.AuthEventIDs()))
+		for _, authEventID := range event.AuthEventIDs() {
+			authEventNID, ok := cache[authEventID]
+			if !ok {
+				return fmt.Errorf("missing auth event NID for event %s", event.EventID())
+			}
+			authEventNIDs = append(authEventNIDs, authEventNID)
+		}
+
+		eventNID, _, _, _, err := db.StoreEvent(ctx, event.Headered(roomVersion), authEventNIDs, false)
+		if err != nil {
+			return fmt.Errorf("db.StoreEvent: %w", err)
+		}
+		cache[event.EventID()] = eventNID
+	}
+
+	return nil
+}
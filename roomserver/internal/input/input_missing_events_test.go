@@ -0,0 +1,272 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const testMissingEventsRoomVersion = gomatrixserverlib.RoomVersionV2
+
+// fakeMissingEventsFetcher is a missingEventsFetcher whose responses and
+// call counts are entirely controlled by the test.
+type fakeMissingEventsFetcher struct {
+	missingEvents []*gomatrixserverlib.Event
+	missingErr    error
+	stateEvents   []*gomatrixserverlib.Event
+	authEvents    []*gomatrixserverlib.Event
+	stateErr      error
+
+	lookupMissingCalls int
+	lookupStateCalls   int
+	lastLimit          int
+	lastEarliest       []string
+	lastLatest         []string
+}
+
+func (f *fakeMissingEventsFetcher) LookupMissingEvents(
+	ctx context.Context, origin gomatrixserverlib.ServerName, roomID string,
+	earliestEvents, latestEvents []string, limit int, roomVersion gomatrixserverlib.RoomVersion,
+) ([]*gomatrixserverlib.Event, error) {
+	f.lookupMissingCalls++
+	f.lastLimit = limit
+	f.lastEarliest = earliestEvents
+	f.lastLatest = latestEvents
+	return f.missingEvents, f.missingErr
+}
+
+func (f *fakeMissingEventsFetcher) LookupState(
+	ctx context.Context, origin gomatrixserverlib.ServerName, roomID, eventID string,
+	roomVersion gomatrixserverlib.RoomVersion,
+) ([]*gomatrixserverlib.Event, []*gomatrixserverlib.Event, error) {
+	f.lookupStateCalls++
+	return f.stateEvents, f.authEvents, f.stateErr
+}
+
+// fakeMissingEventsStorage is a missingEventsStorage whose known event
+// NIDs and stored events are entirely controlled by the test.
+type fakeMissingEventsStorage struct {
+	knownEventNIDs map[string]types.EventNID
+
+	storedEventIDs []string
+	nextEventNID   types.EventNID
+}
+
+func (f *fakeMissingEventsStorage) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	result := make(map[string]types.EventNID)
+	for _, eventID := range eventIDs {
+		if nid, ok := f.knownEventNIDs[eventID]; ok {
+			result[eventID] = nid
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeMissingEventsStorage) StoreEvent(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, authEventNIDs []types.EventNID, isRejected bool,
+) (types.EventNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	f.nextEventNID++
+	f.storedEventIDs = append(f.storedEventIDs, event.EventID())
+	if f.knownEventNIDs == nil {
+		f.knownEventNIDs = map[string]types.EventNID{}
+	}
+	f.knownEventNIDs[event.EventID()] = f.nextEventNID
+	return f.nextEventNID, types.StateAtEvent{}, nil, "", nil
+}
+
+func mustMakeEvent(t *testing.T, eventID, roomID string, prevEventIDs []string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	return mustMakeEventWithAuth(t, eventID, roomID, prevEventIDs, nil)
+}
+
+func mustMakeEventWithAuth(t *testing.T, eventID, roomID string, prevEventIDs, authEventIDs []string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	if prevEventIDs == nil {
+		prevEventIDs = []string{}
+	}
+	if authEventIDs == nil {
+		authEventIDs = []string{}
+	}
+	prevJSON, err := json.Marshal(prevEventIDs)
+	if err != nil {
+		t.Fatalf("failed to marshal prev_events: %v", err)
+	}
+	authJSON, err := json.Marshal(authEventIDs)
+	if err != nil {
+		t.Fatalf("failed to marshal auth_events: %v", err)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":%q,"sender":"@alice:example.com","type":"m.room.message","content":{},"prev_events":%s,"auth_events":%s,"depth":1,"origin_server_ts":0}`,
+		eventID, roomID, prevJSON, authJSON,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, testMissingEventsRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build test event %s: %v", eventID, err)
+	}
+	return ev.Headered(testMissingEventsRoomVersion)
+}
+
+func TestFetchMissingPrevEventsBackfillsMissingEvent(t *testing.T) {
+	triggering := mustMakeEvent(t, "$triggering", "!room:example.com", []string{"$missing1"})
+	missingEvent := mustMakeEvent(t, "$missing1", "!room:example.com", []string{"$older"})
+
+	fetcher := &fakeMissingEventsFetcher{
+		missingEvents: []*gomatrixserverlib.Event{missingEvent.Unwrap()},
+	}
+	db := &fakeMissingEventsStorage{}
+
+	var processed []string
+	processFn := func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		processed = append(processed, input.Event.EventID())
+		if got := remainingMissingEventsDepth(ctx); got != maxMissingEventsDepth-1 {
+			t.Errorf("expected depth budget decremented by one, got %d", got)
+		}
+		return input.Event.EventID(), nil
+	}
+
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: triggering, Origin: "origin.example.com"}
+	logger := logrus.NewEntry(logrus.New())
+
+	err := fetchMissingPrevEvents(context.Background(), fetcher, db, processFn, input, nil, maxMissingEventsDepth, logger)
+	if err != nil {
+		t.Fatalf("fetchMissingPrevEvents returned error: %v", err)
+	}
+	if fetcher.lookupMissingCalls != 1 {
+		t.Errorf("expected 1 LookupMissingEvents call, got %d", fetcher.lookupMissingCalls)
+	}
+	if fetcher.lastLimit != missingEventsFetchBreadth {
+		t.Errorf("expected limit to be missingEventsFetchBreadth (%d), got %d", missingEventsFetchBreadth, fetcher.lastLimit)
+	}
+	if len(fetcher.lastLatest) != 1 || fetcher.lastLatest[0] != "$triggering" {
+		t.Errorf("expected latestEvents to be the triggering event, got %v", fetcher.lastLatest)
+	}
+	if len(fetcher.lastEarliest) != 0 {
+		t.Errorf("expected earliestEvents to be what we already have (none here), got %v", fetcher.lastEarliest)
+	}
+	if len(processed) != 1 || processed[0] != "$missing1" {
+		t.Errorf("expected backfilled event to be processed, got %v", processed)
+	}
+	if fetcher.lookupStateCalls != 0 {
+		t.Errorf("did not expect a state fallback, got %d calls", fetcher.lookupStateCalls)
+	}
+}
+
+// TestFetchMissingPrevEventsBreadthIndependentOfDepth checks that the
+// per-call breadth limit doesn't shrink as the recursive depth budget is
+// consumed - the two are separate knobs.
+func TestFetchMissingPrevEventsBreadthIndependentOfDepth(t *testing.T) {
+	triggering := mustMakeEvent(t, "$triggering4", "!room:example.com", []string{"$missing4"})
+	fetcher := &fakeMissingEventsFetcher{}
+	db := &fakeMissingEventsStorage{}
+	processFn := func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		return input.Event.EventID(), nil
+	}
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: triggering, Origin: "origin.example.com"}
+	logger := logrus.NewEntry(logrus.New())
+
+	// remaining is nearly exhausted, but the breadth limit shouldn't care.
+	if err := fetchMissingPrevEvents(context.Background(), fetcher, db, processFn, input, nil, 1, logger); err != nil {
+		t.Fatalf("fetchMissingPrevEvents returned error: %v", err)
+	}
+	if fetcher.lastLimit != missingEventsFetchBreadth {
+		t.Errorf("expected limit to stay at missingEventsFetchBreadth (%d) regardless of remaining depth, got %d", missingEventsFetchBreadth, fetcher.lastLimit)
+	}
+}
+
+func TestFetchMissingPrevEventsFallsBackToState(t *testing.T) {
+	triggering := mustMakeEvent(t, "$triggering2", "!room:example.com", []string{"$missing2"})
+
+	state1 := mustMakeEvent(t, "$state1", "!room:example.com", nil)
+	state2 := mustMakeEvent(t, "$state2", "!room:example.com", nil)
+	auth1 := mustMakeEvent(t, "$auth1", "!room:example.com", nil)
+
+	fetcher := &fakeMissingEventsFetcher{
+		missingEvents: nil, // origin couldn't close the gap
+		stateEvents:   []*gomatrixserverlib.Event{state1.Unwrap(), state2.Unwrap()},
+		authEvents:    []*gomatrixserverlib.Event{auth1.Unwrap()},
+	}
+	db := &fakeMissingEventsStorage{}
+
+	processFn := func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		t.Fatalf("processFn should not be called when falling back to state")
+		return "", nil
+	}
+
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: triggering, Origin: "origin.example.com"}
+	logger := logrus.NewEntry(logrus.New())
+
+	err := fetchMissingPrevEvents(context.Background(), fetcher, db, processFn, input, nil, maxMissingEventsDepth, logger)
+	if err != nil {
+		t.Fatalf("fetchMissingPrevEvents returned error: %v", err)
+	}
+	if fetcher.lookupStateCalls != 1 {
+		t.Errorf("expected 1 LookupState call, got %d", fetcher.lookupStateCalls)
+	}
+	if !input.HasState {
+		t.Error("expected HasState to be set after falling back to state")
+	}
+	if len(input.StateEventIDs) != 2 {
+		t.Errorf("expected 2 state event IDs, got %v", input.StateEventIDs)
+	}
+	if len(input.AuthEventIDs) != 1 {
+		t.Errorf("expected 1 auth event ID, got %v", input.AuthEventIDs)
+	}
+	if len(db.storedEventIDs) != 3 {
+		t.Errorf("expected all 3 fetched state/auth events to be stored, got %v", db.storedEventIDs)
+	}
+}
+
+// TestFetchStateAfterMissingEventsSetsState checks that falling back to
+// /state both marks the input event as carrying its own state and
+// actually stores the fetched state and auth chain events - without the
+// latter, calculateAndSetState's subsequent lookup of these state event
+// IDs would find nothing.
+func TestFetchStateAfterMissingEventsSetsState(t *testing.T) {
+	ev := mustMakeEvent(t, "$ev3", "!room:example.com", nil)
+	auth := mustMakeEvent(t, "$a1", "!room:example.com", nil)
+	state := mustMakeEventWithAuth(t, "$s1", "!room:example.com", nil, []string{"$a1"})
+
+	fetcher := &fakeMissingEventsFetcher{
+		stateEvents: []*gomatrixserverlib.Event{state.Unwrap()},
+		authEvents:  []*gomatrixserverlib.Event{auth.Unwrap()},
+	}
+	db := &fakeMissingEventsStorage{}
+	input := &api.InputRoomEvent{Kind: api.KindNew, Event: ev}
+
+	if err := fetchStateAfterMissingEvents(context.Background(), fetcher, db, input); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !input.HasState || len(input.StateEventIDs) != 1 {
+		t.Errorf("expected state to be set, got %+v", input)
+	}
+	if len(input.AuthEventIDs) != 1 {
+		t.Errorf("expected 1 auth event ID, got %+v", input.AuthEventIDs)
+	}
+
+	if len(db.storedEventIDs) != 2 {
+		t.Fatalf("expected both the auth event and the state event to be stored, got %v", db.storedEventIDs)
+	}
+	if db.storedEventIDs[0] != "$a1" || db.storedEventIDs[1] != "$s1" {
+		t.Errorf("expected the auth event to be stored before the state event that depends on it, got %v", db.storedEventIDs)
+	}
+}
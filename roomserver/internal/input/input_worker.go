@@ -0,0 +1,346 @@
+// Copyright 2017 Vector Creations Ltd
+// Copyright 2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(roomInputQueueDepth)
+}
+
+// roomInputQueueDepth reports how many events are currently queued for a
+// given room's worker, so that operators can see when a single busy room
+// is falling behind.
+var roomInputQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "room_input_queue_depth",
+		Help:      "The number of events currently queued for processing for a given room",
+	},
+	[]string{"room_id"},
+)
+
+const (
+	// roomWorkerQueueSize is how many events may be queued for a single
+	// room's worker before InputRoomEvent starts to block, providing
+	// backpressure on whatever is feeding us events (e.g. the input
+	// JetStream consumer) when one room falls behind.
+	roomWorkerQueueSize = 64
+
+	// roomWorkerIdleTimeout is how long a per-room worker will sit idle,
+	// with nothing queued, before it shuts itself down. A new worker is
+	// started the next time an event for that room arrives.
+	roomWorkerIdleTimeout = 30 * time.Second
+)
+
+// roomInputTask is a single unit of work submitted to a room's worker.
+type roomInputTask struct {
+	ctx    context.Context
+	input  *api.InputRoomEvent
+	result chan<- roomInputResult
+}
+
+// roomInputResult is sent back to the submitter of a roomInputTask once
+// processRoomEvent has returned.
+type roomInputResult struct {
+	eventID string
+	err     error
+}
+
+// roomWorker processes every event for a single room, strictly in the
+// order it was submitted. Running one worker goroutine per room is what
+// allows different rooms to be processed concurrently while still
+// guaranteeing in-order, mutually-exclusive handling of the state deltas
+// for any one room.
+type roomWorker struct {
+	roomID string
+	queue  chan roomInputTask
+
+	// process is what actually handles a task; it's r.processRoomEvent in
+	// production. Taking it as a field rather than always going through
+	// an *Inputer means the ordering/parallelism/teardown behaviour below
+	// can be unit tested (see input_worker_test.go) against a fake that
+	// doesn't need a real *Inputer (roomserver DB, federation API, etc.)
+	// behind it.
+	process func(ctx context.Context, input *api.InputRoomEvent) (string, error)
+
+	// stateMu additionally guards the updateLatestEvents/state-delta
+	// critical section of processRoomEvent, so that the invariant holds
+	// even if a future change allows more than one goroutine to drain
+	// this queue.
+	stateMu sync.Mutex
+
+	// lifecycleMu guards closed and inFlightSends, and must be held for
+	// the combination of "check closed, then record an in-flight send"
+	// (by submitters) and "check queue empty and nothing in flight, then
+	// mark closed" (by the idle-timeout teardown below) to be race-free.
+	// Without that, a submitter could observe the worker as live, enqueue,
+	// and then the idle timer could tear the worker down without ever
+	// draining that enqueued task - leaving InputRoomEvent blocked forever
+	// waiting on a result that will never arrive.
+	lifecycleMu sync.Mutex
+	closed      bool
+
+	// inFlightSends counts submitters that have been cleared to send on
+	// queue but haven't finished doing so yet. submit must not hold
+	// lifecycleMu across its (potentially blocking) send on queue: the
+	// idle-timeout teardown below also takes lifecycleMu, and if it held
+	// it while submit was blocked sending to a full queue, the two would
+	// deadlock against each other forever. Tracking in-flight sends here
+	// instead lets the teardown check "is it truly safe to close" without
+	// requiring submit to hold the lock for the send itself.
+	inFlightSends int
+}
+
+// newRoomWorker constructs a roomWorker for roomID that dispatches tasks
+// to process. It does not start the worker's goroutine or register it in
+// roomWorkers; see getOrStartRoomWorker for that.
+func newRoomWorker(roomID string, process func(ctx context.Context, input *api.InputRoomEvent) (string, error)) *roomWorker {
+	return &roomWorker{
+		roomID:  roomID,
+		queue:   make(chan roomInputTask, roomWorkerQueueSize),
+		process: process,
+	}
+}
+
+// submit enqueues task on the worker's queue, returning false instead if
+// the worker has already been (or is concurrently being) torn down by
+// its idle timeout. A false return means the caller must obtain a fresh
+// worker via getOrStartRoomWorker and retry.
+//
+// The send on w.queue deliberately happens outside of lifecycleMu: the
+// queue can be full, making the send block, and the idle-timeout
+// teardown in runRoomWorker needs lifecycleMu to decide whether it's
+// safe to close the worker. Holding the lock across the send would let
+// those two block on each other - a submitter waiting for room in a full
+// queue while holding the lock, and the teardown waiting for the lock
+// while the submitter waits for room the teardown itself would free up
+// by draining the queue. Recording the send as in-flight, instead of
+// holding the lock for its duration, gives the teardown path the same
+// "nothing could still land on this queue" guarantee without that risk.
+func (w *roomWorker) submit(task roomInputTask) bool {
+	w.lifecycleMu.Lock()
+	if w.closed {
+		w.lifecycleMu.Unlock()
+		return false
+	}
+	w.inFlightSends++
+	w.lifecycleMu.Unlock()
+
+	w.queue <- task
+
+	w.lifecycleMu.Lock()
+	w.inFlightSends--
+	w.lifecycleMu.Unlock()
+
+	return true
+}
+
+// roomWorkerKey scopes a room's worker to the *Inputer instance that
+// owns it, so that two Inputers (e.g. in tests, or multiple processes
+// sharing this package's state in-process) never run each other's
+// processRoomEvent or share queues for what they each think is "their"
+// room.
+type roomWorkerKey struct {
+	inputer *Inputer
+	roomID  string
+}
+
+// roomWorkers holds the currently-running per-room workers, keyed by
+// (Inputer, room ID). Workers are started lazily on first use and torn
+// down again after roomWorkerIdleTimeout with nothing to do.
+var (
+	roomWorkers   = map[roomWorkerKey]*roomWorker{}
+	roomWorkersMu sync.Mutex
+)
+
+// InputRoomEvent is the entry point that must be used to submit a single
+// event for processing; it replaces calling processRoomEvent directly,
+// which historically (TODO #375) could only ever happen once at a time
+// for the whole module. Unlike processRoomEvent, it is safe to call
+// concurrently for different rooms: events for the same room share a
+// worker and are processed strictly in submission order, while events
+// for different rooms run on separate goroutines in parallel.
+//
+// OnMessage below is the JetStream consumer handler that calls this for
+// every inbound event, so that per-room sharding and backpressure apply
+// on the real ingest path and not just to callers within this package.
+func (r *Inputer) InputRoomEvent(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+	roomID := input.Event.RoomID()
+	resultCh := make(chan roomInputResult, 1)
+
+	for {
+		worker := r.getOrStartRoomWorker(roomID)
+		if worker.submit(roomInputTask{ctx: ctx, input: input, result: resultCh}) {
+			roomInputQueueDepth.With(prometheus.Labels{"room_id": roomID}).Inc()
+			break
+		}
+		// The worker we found was torn down between being returned and us
+		// submitting to it; loop round and start a replacement.
+	}
+
+	result := <-resultCh
+	return result.eventID, result.err
+}
+
+// getOrStartRoomWorker returns the worker for roomID, starting a new one
+// (and its processing goroutine) if none is currently running.
+func (r *Inputer) getOrStartRoomWorker(roomID string) *roomWorker {
+	key := roomWorkerKey{inputer: r, roomID: roomID}
+
+	roomWorkersMu.Lock()
+	defer roomWorkersMu.Unlock()
+
+	if worker, ok := roomWorkers[key]; ok {
+		return worker
+	}
+
+	worker := newRoomWorker(roomID, r.processRoomEvent)
+	roomWorkers[key] = worker
+	go runRoomWorker(key, worker, roomWorkerIdleTimeout)
+	return worker
+}
+
+// runRoomWorker drains worker.queue, processing one event at a time via
+// worker.process, for as long as events keep arriving within idleTimeout.
+// Once the worker goes idle for too long it removes itself from
+// roomWorkers and exits; the next InputRoomEvent call for that room will
+// start a fresh one. It is a free function (rather than an *Inputer
+// method) so that tests can drive a roomWorker directly with a fake
+// process func, independent of getOrStartRoomWorker/roomWorkers.
+func runRoomWorker(key roomWorkerKey, worker *roomWorker, idleTimeout time.Duration) {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case task := <-worker.queue:
+			roomInputQueueDepth.With(prometheus.Labels{"room_id": worker.roomID}).Dec()
+
+			worker.stateMu.Lock()
+			eventID, err := worker.process(task.ctx, task.input)
+			worker.stateMu.Unlock()
+
+			task.result <- roomInputResult{eventID: eventID, err: err}
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idleTimeout)
+		case <-timer.C:
+			// Mark the worker closed (so that any submitter racing us
+			// sees it and retries against a fresh worker) in the same
+			// critical section as the "is there anything left to do"
+			// check, so that nothing can be enqueued onto a worker we're
+			// about to abandon. inFlightSends catches a submitter that
+			// has already been cleared to send (see submit) but hasn't
+			// reached the channel yet - without it, we could close the
+			// worker out from under that send.
+			worker.lifecycleMu.Lock()
+			if len(worker.queue) > 0 || worker.inFlightSends > 0 {
+				worker.lifecycleMu.Unlock()
+				timer.Reset(idleTimeout)
+				continue
+			}
+			worker.closed = true
+			worker.lifecycleMu.Unlock()
+
+			roomWorkersMu.Lock()
+			delete(roomWorkers, key)
+			roomWorkersMu.Unlock()
+			return
+		}
+	}
+}
+
+// OnMessage is the JetStream consumer handler registered against the
+// roomserver input subject; it's what feeds real, federation- and
+// client-API-submitted events into InputRoomEvent. It replaces the
+// previous handler, which called processRoomEvent directly once per
+// message in sequence - that meant a single slow or misbehaving room at
+// the front of a batch held up every other room's events behind it on
+// the same consumer, even though processRoomEvent itself has no need to
+// serialise across rooms.
+//
+// Messages are grouped by room ID, preserving each room's original order
+// within the batch, and each group is handed to InputRoomEvent
+// sequentially from its own goroutine. Different rooms are processed in
+// parallel this way, while two messages for the same room arriving in
+// the same batch (e.g. a room-creation burst: create, join, power
+// levels) are still submitted in the order they were received rather
+// than racing each other into that room's worker queue - dispatching
+// them all concurrently would let a later event's
+// checkForMissingPrevEvents see an earlier, not-yet-stored local event
+// as "missing" and try (and fail) to federate for it. Acking the whole
+// batch only after every message's InputRoomEvent call has returned
+// means a room whose worker queue is full naturally slows this consumer
+// down (and with it, JetStream's redelivery of further messages) rather
+// than silently dropping or reordering work.
+func (r *Inputer) OnMessage(ctx context.Context, msgs []*nats.Msg) bool {
+	results := make([]error, len(msgs))
+
+	roomIndices := make(map[string][]int)
+	roomOrder := make([]string, 0, len(msgs))
+	inputs := make([]*api.InputRoomEvent, len(msgs))
+	for i, msg := range msgs {
+		var input api.InputRoomEvent
+		if err := json.Unmarshal(msg.Data, &input); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("roomserver input: failed to unmarshal InputRoomEvent")
+			results[i] = err
+			continue
+		}
+		inputs[i] = &input
+
+		roomID := input.Event.RoomID()
+		if _, ok := roomIndices[roomID]; !ok {
+			roomOrder = append(roomOrder, roomID)
+		}
+		roomIndices[roomID] = append(roomIndices[roomID], i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(roomOrder))
+	for _, roomID := range roomOrder {
+		go func(indices []int) {
+			defer wg.Done()
+			for _, i := range indices {
+				_, results[i] = r.InputRoomEvent(ctx, inputs[i])
+			}
+		}(roomIndices[roomID])
+	}
+	wg.Wait()
+
+	ok := true
+	for i, err := range results {
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("subject", msgs[i].Subject).Error("roomserver input: failed to process event")
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,236 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// eventIDForSeq and seqFromEventID let the ordering test below smuggle a
+// sequence number through an event ID, so the fake process func can
+// report which submission it actually processed.
+func eventIDForSeq(seq int) string {
+	return fmt.Sprintf("$seq%d", seq)
+}
+
+func seqFromEventID(eventID string) int {
+	seq, err := strconv.Atoi(strings.TrimPrefix(eventID, "$seq"))
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+// submitAndWait submits input to worker, which the caller has already
+// constructed and started running, and waits for its result. It mirrors
+// what InputRoomEvent does, but against a roomWorker the test constructs
+// directly rather than one reached via getOrStartRoomWorker, so these
+// tests don't need a real *Inputer.
+func submitAndWait(t *testing.T, worker *roomWorker, input *api.InputRoomEvent) (string, error) {
+	t.Helper()
+	resultCh := make(chan roomInputResult, 1)
+	if !worker.submit(roomInputTask{ctx: context.Background(), input: input, result: resultCh}) {
+		t.Fatalf("submit unexpectedly failed on a fresh worker")
+	}
+	select {
+	case result := <-resultCh:
+		return result.eventID, result.err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for result")
+		return "", nil
+	}
+}
+
+// TestRoomWorkerOrdersEventsWithinARoom checks that events submitted to a
+// single room's worker are processed strictly in submission order, and
+// never overlap with each other - the two properties that make per-room
+// sharding safe for state calculation.
+func TestRoomWorkerOrdersEventsWithinARoom(t *testing.T) {
+	const n = 50
+
+	var mu sync.Mutex
+	var processed []int
+	var active int32
+
+	worker := newRoomWorker("!room:example.com", func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		mu.Lock()
+		active++
+		if active > 1 {
+			mu.Unlock()
+			t.Fatalf("processRoomEvent ran concurrently with itself for the same room")
+		}
+		mu.Unlock()
+
+		// Give a concurrent call, if there were one, a chance to land.
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		seq := seqFromEventID(input.Event.EventID())
+
+		mu.Lock()
+		processed = append(processed, seq)
+		mu.Unlock()
+		return input.Event.EventID(), nil
+	})
+	go runRoomWorker(roomWorkerKey{roomID: worker.roomID}, worker, time.Minute)
+
+	for i := 0; i < n; i++ {
+		ev := mustMakeEvent(t, eventIDForSeq(i), worker.roomID, nil)
+		if _, err := submitAndWait(t, worker, &api.InputRoomEvent{Kind: api.KindNew, Event: ev}); err != nil {
+			t.Fatalf("submitAndWait returned error: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(processed) != n {
+		t.Fatalf("expected %d events processed, got %d", n, len(processed))
+	}
+	for i, seq := range processed {
+		if seq != i {
+			t.Fatalf("expected event %d to be processed at position %d, got event %d", i, i, seq)
+		}
+	}
+}
+
+// TestRoomWorkerCrossRoomParallelism checks that two different rooms'
+// workers can have events in flight at the same time - i.e. that
+// sharding by room doesn't collapse back into global serialisation.
+func TestRoomWorkerCrossRoomParallelism(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan string, 2)
+
+	process := func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		entered <- input.Event.RoomID()
+		<-release
+		return input.Event.EventID(), nil
+	}
+
+	workerA := newRoomWorker("!roomA:example.com", process)
+	workerB := newRoomWorker("!roomB:example.com", process)
+	go runRoomWorker(roomWorkerKey{roomID: workerA.roomID}, workerA, time.Minute)
+	go runRoomWorker(roomWorkerKey{roomID: workerB.roomID}, workerB, time.Minute)
+
+	resultA := make(chan roomInputResult, 1)
+	resultB := make(chan roomInputResult, 1)
+	evA := mustMakeEvent(t, "$a1", workerA.roomID, nil)
+	evB := mustMakeEvent(t, "$b1", workerB.roomID, nil)
+
+	if !workerA.submit(roomInputTask{ctx: context.Background(), input: &api.InputRoomEvent{Kind: api.KindNew, Event: evA}, result: resultA}) {
+		t.Fatalf("submit to workerA failed")
+	}
+	if !workerB.submit(roomInputTask{ctx: context.Background(), input: &api.InputRoomEvent{Kind: api.KindNew, Event: evB}, result: resultB}) {
+		t.Fatalf("submit to workerB failed")
+	}
+
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case roomID := <-entered:
+			seen[roomID] = true
+		case <-timeout:
+			t.Fatalf("timed out waiting for both rooms to be in flight concurrently, only saw %v", seen)
+		}
+	}
+	close(release)
+
+	<-resultA
+	<-resultB
+}
+
+// TestRoomWorkerSubmitDoesNotHoldLifecycleMuAcrossSend guards against a
+// deadlock where submit held lifecycleMu for the full duration of its
+// (potentially blocking) send on queue. The idle-timeout branch in
+// runRoomWorker also takes lifecycleMu, to decide whether it's safe to
+// close the worker; if a submitter were blocked sending to a full queue
+// while holding that lock, runRoomWorker could never acquire it to check
+// whether draining would help, and the two would deadlock forever. This
+// test has no reader on queue at all, so a submit attempting to send is
+// guaranteed to block - and checks that lifecycleMu remains acquirable
+// by someone else while that block is in progress.
+func TestRoomWorkerSubmitDoesNotHoldLifecycleMuAcrossSend(t *testing.T) {
+	worker := &roomWorker{
+		roomID: "!deadlock:example.com",
+		queue:  make(chan roomInputTask), // unbuffered, and nothing ever reads it
+	}
+
+	ev := mustMakeEvent(t, eventIDForSeq(0), worker.roomID, nil)
+	go worker.submit(roomInputTask{ctx: context.Background(), input: &api.InputRoomEvent{Kind: api.KindNew, Event: ev}, result: make(chan roomInputResult, 1)})
+
+	// Give the submit above every chance to reach (and block on) its send
+	// before we check whether it's still holding the lock.
+	time.Sleep(50 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		worker.lifecycleMu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		worker.lifecycleMu.Unlock()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("submit is still holding lifecycleMu while blocked sending on queue - this would deadlock against runRoomWorker's idle-timeout branch")
+	}
+}
+
+// TestRoomWorkerIdleTeardownRace hammers submit concurrently with the
+// idle-timeout teardown path, using a very short idle timeout, to catch
+// (under go test -race) any unsynchronised access between submitters and
+// the teardown goroutine, and to check that a submit against a torn-down
+// worker fails cleanly (returns false) rather than hanging or panicking.
+func TestRoomWorkerIdleTeardownRace(t *testing.T) {
+	process := func(ctx context.Context, input *api.InputRoomEvent) (string, error) {
+		return input.Event.EventID(), nil
+	}
+
+	worker := newRoomWorker("!race:example.com", process)
+	key := roomWorkerKey{roomID: worker.roomID}
+	go runRoomWorker(key, worker, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ev := mustMakeEvent(t, eventIDForSeq(i), worker.roomID, nil)
+			resultCh := make(chan roomInputResult, 1)
+			if worker.submit(roomInputTask{ctx: context.Background(), input: &api.InputRoomEvent{Kind: api.KindNew, Event: ev}, result: resultCh}) {
+				select {
+				case <-resultCh:
+				case <-time.After(2 * time.Second):
+					t.Errorf("submit %d succeeded but never got a result", i)
+				}
+			}
+			// A false return (worker torn down concurrently) is also a
+			// valid, non-hanging outcome - the caller is expected to
+			// retry against a fresh worker via getOrStartRoomWorker.
+		}(i)
+	}
+	wg.Wait()
+}